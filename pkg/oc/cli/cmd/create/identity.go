@@ -1,19 +1,38 @@
 package create
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/ghodss/yaml"
 	"github.com/spf13/cobra"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
 	"k8s.io/kubernetes/pkg/kubectl/cmd/templates"
 	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
 	kcmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+	"k8s.io/kubernetes/pkg/kubectl/cmd/util/editor"
+	"k8s.io/kubernetes/pkg/kubectl/genericclioptions"
+	"k8s.io/kubernetes/pkg/kubectl/genericclioptions/printers"
+	"k8s.io/kubernetes/pkg/kubectl/validation"
+
+	kapi "k8s.io/kubernetes/pkg/apis/core"
 
 	userapi "github.com/openshift/origin/pkg/user/apis/user"
+	userv1 "github.com/openshift/origin/pkg/user/apis/user/v1"
 	userclientinternal "github.com/openshift/origin/pkg/user/generated/internalclientset"
+	userscheme "github.com/openshift/origin/pkg/user/generated/internalclientset/scheme"
 	userclient "github.com/openshift/origin/pkg/user/generated/internalclientset/typed/user/internalversion"
 )
 
@@ -28,32 +47,127 @@ var (
 		be created manually.
 
 		Corresponding user and useridentitymapping objects must also be created
-		to allow logging in with the created identity.`)
+		to allow logging in with the created identity.
+
+		Instead of a single <PROVIDER_NAME>:<PROVIDER_USER_NAME> argument, a batch
+		of identity, user, and useridentitymapping tuples can be provisioned at once
+		by passing one or more --filename sources describing them in CSV, JSON, or
+		YAML form. Each row is created atomically; if the user or mapping for a row
+		cannot be created, the identity created for that row is rolled back.
+
+		Pass --edit to open the identity in your editor before it is submitted,
+		for example to add Extra fields or provider groups.`)
 
 	identityExample = templates.Examples(`
 		# Create an identity with identity provider "acme_ldap" and the identity provider username "adamjones"
-  	%[1]s acme_ldap:adamjones`)
+  	%[1]s acme_ldap:adamjones
+
+		# Bulk-create identities, users, and mappings described in a CSV file
+  	%[1]s -f ldap-import.csv
+
+		# Read the same kind of rows from stdin as YAML
+  	cat ldap-import.yaml | %[1]s -f -
+
+		# Edit the identity in $EDITOR before creating it
+  	%[1]s acme_ldap:adamjones --edit`)
+)
+
+// identityRow describes a single identity/user/mapping tuple to provision in
+// a bulk --filename import. It is the common shape that CSV, JSON, and YAML
+// input rows are normalized to.
+type identityRow struct {
+	ProviderName     string `json:"provider" yaml:"provider"`
+	ProviderUserName string `json:"provider_user" yaml:"provider_user"`
+	UserName         string `json:"user" yaml:"user"`
+}
+
+func (r identityRow) validate() error {
+	if len(r.ProviderName) == 0 {
+		return fmt.Errorf("provider is required")
+	}
+	if len(r.ProviderUserName) == 0 {
+		return fmt.Errorf("provider_user is required")
+	}
+	if len(r.UserName) == 0 {
+		return fmt.Errorf("user is required")
+	}
+	return nil
+}
+
+// DryRunStrategy identifies how a create request should be handled without
+// persisting anything, mirroring the client/server dry-run modes kubectl
+// create grew for other resources.
+type DryRunStrategy int
+
+const (
+	// DryRunNone indicates the object should be created normally.
+	DryRunNone DryRunStrategy = iota
+	// DryRunClient indicates the object should not be sent to the server at all.
+	DryRunClient
+	// DryRunServer indicates the object should be sent to the server with the
+	// dry-run option set, so that validation and admission run without the
+	// object being persisted.
+	DryRunServer
 )
 
+func getDryRunStrategy(cmd *cobra.Command) (DryRunStrategy, error) {
+	switch value := cmdutil.GetFlagString(cmd, "dry-run"); value {
+	case "none", "":
+		return DryRunNone, nil
+	case "client":
+		return DryRunClient, nil
+	case "server":
+		return DryRunServer, nil
+	default:
+		return DryRunNone, fmt.Errorf(`invalid dry-run value (%v). Must be "none", "client", or "server"`, value)
+	}
+}
+
 type CreateIdentityOptions struct {
 	ProviderName     string
 	ProviderUserName string
 
+	// Filenames holds one or more --filename sources (paths, directories,
+	// URLs, or "-" for stdin) describing identity/user/mapping rows to
+	// bulk-create.
+	Filenames []string
+
 	IdentityClient userclient.IdentityInterface
+	UserClient     userclient.UserInterface
+	MappingClient  userclient.UserIdentityMappingInterface
+
+	// RESTClient is used, in addition to the typed clients above, to issue
+	// server-side dry-run creates: the generated typed clients have no
+	// CreateOptions parameter to carry a dry-run flag, so DryRunServer bypasses
+	// them and posts directly with a "dryRun=All" query parameter.
+	RESTClient rest.Interface
 
-	DryRun bool
+	DryRunStrategy DryRunStrategy
 
-	OutputFormat string
-	Out          io.Writer
-	Printer      ObjectPrinter
+	// ValidateSchema, when true, validates the constructed Identity against
+	// the server's OpenAPI schema before it is submitted.
+	ValidateSchema bool
+	Schema         validation.Schema
+
+	// EditBeforeCreate, when true, opens the constructed Identity in the
+	// user's editor before it is submitted.
+	EditBeforeCreate bool
+
+	PrintFlags *genericclioptions.PrintFlags
+	Printer    printers.ResourcePrinter
+
+	Out io.Writer
 }
 
 // NewCmdCreateIdentity is a macro command to create a new identity
 func NewCmdCreateIdentity(name, fullName string, f kcmdutil.Factory, out io.Writer) *cobra.Command {
-	o := &CreateIdentityOptions{Out: out}
+	o := &CreateIdentityOptions{
+		PrintFlags: genericclioptions.NewPrintFlags("created").WithTypeSetter(userscheme.Scheme),
+		Out:        out,
+	}
 
 	cmd := &cobra.Command{
-		Use:     name + " <PROVIDER_NAME>:<PROVIDER_USER_NAME>",
+		Use:     name + " <PROVIDER_NAME>:<PROVIDER_USER_NAME> [-f FILENAME]",
 		Short:   "Manually create an identity (only needed if automatic creation is disabled).",
 		Long:    identityLong,
 		Example: fmt.Sprintf(identityExample, fullName),
@@ -64,27 +178,44 @@ func NewCmdCreateIdentity(name, fullName string, f kcmdutil.Factory, out io.Writ
 		},
 	}
 
-	cmdutil.AddDryRunFlag(cmd)
-	cmdutil.AddPrinterFlags(cmd)
+	cmd.Flags().StringSliceVarP(&o.Filenames, "filename", "f", o.Filenames, "Filename, directory, or URL to a CSV, JSON, or YAML file containing provider,provider_user,user rows to bulk-create")
+	cmd.Flags().String("dry-run", "none", `Must be "none", "client", or "server". If "client", only print the object that would be sent, without sending it. If "server", submit the request to the server with the dry-run flag set, which will process and validate the request without persisting the result.`)
+	cmd.Flags().Bool("validate", true, "If true, use a schema to validate the input before sending it")
+	cmd.Flags().BoolVar(&o.EditBeforeCreate, "edit", o.EditBeforeCreate, "Edit the identity before creating it")
+	o.PrintFlags.AddFlags(cmd)
 	return cmd
 }
 
 func (o *CreateIdentityOptions) Complete(cmd *cobra.Command, f kcmdutil.Factory, args []string) error {
-	switch len(args) {
-	case 0:
-		return fmt.Errorf("identity name in the format <PROVIDER_NAME>:<PROVIDER_USER_NAME> is required")
-	case 1:
+	switch {
+	case len(o.Filenames) > 0:
+		if len(args) > 0 {
+			return fmt.Errorf("identity name and --filename are mutually exclusive")
+		}
+	case len(args) == 1:
 		parts := strings.Split(args[0], ":")
 		if len(parts) != 2 {
 			return fmt.Errorf("identity name in the format <PROVIDER_NAME>:<PROVIDER_USER_NAME> is required")
 		}
 		o.ProviderName = parts[0]
 		o.ProviderUserName = parts[1]
+	case len(args) == 0:
+		return fmt.Errorf("identity name in the format <PROVIDER_NAME>:<PROVIDER_USER_NAME> is required")
 	default:
 		return fmt.Errorf("exactly one argument (username) is supported, not: %v", args)
 	}
 
-	o.DryRun = cmdutil.GetFlagBool(cmd, "dry-run")
+	dryRunStrategy, err := getDryRunStrategy(cmd)
+	if err != nil {
+		return err
+	}
+	o.DryRunStrategy = dryRunStrategy
+
+	o.ValidateSchema = cmdutil.GetFlagBool(cmd, "validate")
+	o.Schema, err = f.Validator(o.ValidateSchema)
+	if err != nil {
+		return err
+	}
 
 	clientConfig, err := f.ClientConfig()
 	if err != nil {
@@ -95,55 +226,410 @@ func (o *CreateIdentityOptions) Complete(cmd *cobra.Command, f kcmdutil.Factory,
 		return err
 	}
 	o.IdentityClient = client.User().Identities()
+	o.UserClient = client.User().Users()
+	o.MappingClient = client.User().UserIdentityMappings()
+	o.RESTClient = client.User().RESTClient()
 
-	o.OutputFormat = cmdutil.GetFlagString(cmd, "output")
-
-	o.Printer = func(obj runtime.Object, out io.Writer) error {
-		return cmdutil.PrintObject(cmd, obj, out)
+	if o.DryRunStrategy != DryRunNone {
+		if err := o.PrintFlags.Complete("%s (dry run)"); err != nil {
+			return err
+		}
 	}
+	printer, err := o.PrintFlags.ToPrinter()
+	if err != nil {
+		return err
+	}
+	o.Printer = printer
 
 	return nil
 }
 
 func (o *CreateIdentityOptions) Validate() error {
-	if len(o.ProviderName) == 0 {
-		return fmt.Errorf("provider name is required")
-	}
-	if len(o.ProviderUserName) == 0 {
-		return fmt.Errorf("provider user name is required")
+	if len(o.Filenames) == 0 {
+		if len(o.ProviderName) == 0 {
+			return fmt.Errorf("provider name is required")
+		}
+		if len(o.ProviderUserName) == 0 {
+			return fmt.Errorf("provider user name is required")
+		}
 	}
 	if o.IdentityClient == nil {
 		return fmt.Errorf("IdentityClient is required")
 	}
+	if o.UserClient == nil {
+		return fmt.Errorf("UserClient is required")
+	}
+	if o.MappingClient == nil {
+		return fmt.Errorf("MappingClient is required")
+	}
+	if o.DryRunStrategy == DryRunServer && o.RESTClient == nil {
+		return fmt.Errorf("RESTClient is required for --dry-run=server")
+	}
 	if o.Out == nil {
 		return fmt.Errorf("Out is required")
 	}
 	if o.Printer == nil {
 		return fmt.Errorf("Printer is required")
 	}
+	if o.Schema == nil {
+		return fmt.Errorf("Schema is required")
+	}
 
 	return nil
 }
 
 func (o *CreateIdentityOptions) Run() error {
+	if len(o.Filenames) > 0 {
+		return o.runBulk()
+	}
+	return o.createOne(identityRow{
+		ProviderName:     o.ProviderName,
+		ProviderUserName: o.ProviderUserName,
+	}, true)
+}
+
+// runBulk reads identity/user/mapping rows from o.Filenames and creates each
+// of them in turn, streaming a success or error line per row to o.Out. A
+// failure on any one row does not stop processing of the remaining rows.
+func (o *CreateIdentityOptions) runBulk() error {
+	rows, err := readIdentityRows(o.Filenames)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, row := range rows {
+		if err := row.validate(); err != nil {
+			fmt.Fprintf(o.Out, "error: %s:%s: %v\n", row.ProviderName, row.ProviderUserName, err)
+			errs = append(errs, err)
+			continue
+		}
+		if err := o.createOne(row, false); err != nil {
+			fmt.Fprintf(o.Out, "error: %s:%s: %v\n", row.ProviderName, row.ProviderUserName, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d rows failed", len(errs), len(rows))
+	}
+	return nil
+}
+
+// createOne creates the Identity, User, and UserIdentityMapping described by
+// row. If row.UserName is empty (the single-argument form), only the
+// Identity is created. Any failure after the Identity is created rolls the
+// Identity back so that a partially provisioned row is not left behind.
+func (o *CreateIdentityOptions) createOne(row identityRow, printResult bool) error {
 	identity := &userapi.Identity{}
-	identity.ProviderName = o.ProviderName
-	identity.ProviderUserName = o.ProviderUserName
+	identity.Name = fmt.Sprintf("%s:%s", row.ProviderName, row.ProviderUserName)
+	identity.ProviderName = row.ProviderName
+	identity.ProviderUserName = row.ProviderUserName
+
+	if o.EditBeforeCreate && printResult {
+		edited, err := o.editIdentity(identity)
+		if err != nil {
+			return err
+		}
+		identity = edited
+	}
+
+	if err := o.validateObject(identity); err != nil {
+		return err
+	}
 
 	actualIdentity := identity
 
 	var err error
-	if !o.DryRun {
+	switch o.DryRunStrategy {
+	case DryRunClient:
+		// Nothing is sent to the server.
+	case DryRunServer:
+		actualIdentity = &userapi.Identity{}
+		err = o.dryRunCreate("identities", identity, actualIdentity)
+	default:
 		actualIdentity, err = o.IdentityClient.Create(identity)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(row.UserName) > 0 && o.DryRunStrategy != DryRunClient {
+		user := &userapi.User{}
+		user.Name = row.UserName
+
+		var actualUser *userapi.User
+		if o.DryRunStrategy == DryRunServer {
+			actualUser = &userapi.User{}
+			err = o.dryRunCreate("users", user, actualUser)
+		} else {
+			actualUser, err = o.UserClient.Create(user)
+		}
 		if err != nil {
+			o.rollbackIdentity(actualIdentity.Name)
+			return err
+		}
+
+		mapping := &userapi.UserIdentityMapping{}
+		mapping.Name = actualIdentity.Name
+		mapping.Identity = kapi.ObjectReference{Name: actualIdentity.Name, UID: actualIdentity.UID}
+		mapping.User = kapi.ObjectReference{Name: actualUser.Name, UID: actualUser.UID}
+
+		if o.DryRunStrategy == DryRunServer {
+			err = o.dryRunCreate("useridentitymappings", mapping, &userapi.UserIdentityMapping{})
+		} else {
+			_, err = o.MappingClient.Create(mapping)
+		}
+		if err != nil {
+			o.rollbackUser(actualUser.Name)
+			o.rollbackIdentity(actualIdentity.Name)
 			return err
 		}
 	}
 
-	if useShortOutput := o.OutputFormat == "name"; useShortOutput || len(o.OutputFormat) == 0 {
-		cmdutil.PrintSuccess(useShortOutput, o.Out, actualIdentity, o.DryRun, "created")
+	if !printResult {
+		fmt.Fprintf(o.Out, "identity %q created\n", actualIdentity.Name)
 		return nil
 	}
 
-	return o.Printer(actualIdentity, o.Out)
+	return o.Printer.PrintObj(actualIdentity, o.Out)
+}
+
+// rollbackIdentity deletes the Identity created earlier in createOne once a
+// later step in the row fails, so a partially provisioned row is not left
+// behind. If the rollback delete itself fails, the object is orphaned; that
+// is surfaced as a warning rather than silently swallowed, since it violates
+// the atomicity this function is meant to provide. Under DryRunServer, the
+// Identity was never actually persisted (it was created via dryRunCreate),
+// so there is nothing to roll back and issuing a real Delete would risk
+// removing an unrelated, already-existing object of the same name.
+func (o *CreateIdentityOptions) rollbackIdentity(name string) {
+	if o.DryRunStrategy == DryRunServer {
+		return
+	}
+	if err := o.IdentityClient.Delete(name, nil); err != nil {
+		fmt.Fprintf(o.Out, "warning: rollback failed: could not delete identity %q: %v\n", name, err)
+	}
+}
+
+// rollbackUser deletes the User created earlier in createOne once the
+// mapping create for the row fails. As with rollbackIdentity, this is a
+// no-op under DryRunServer since the User was never actually persisted.
+func (o *CreateIdentityOptions) rollbackUser(name string) {
+	if o.DryRunStrategy == DryRunServer {
+		return
+	}
+	if err := o.UserClient.Delete(name, nil); err != nil {
+		fmt.Fprintf(o.Out, "warning: rollback failed: could not delete user %q: %v\n", name, err)
+	}
+}
+
+// dryRunCreate posts obj to resource with the "dryRun=All" query parameter
+// set, so that the server runs admission and validation without persisting
+// anything, decoding the server's response into into. This bypasses the
+// typed per-resource clients, whose generated Create methods take no options
+// argument in this client-gen vintage.
+func (o *CreateIdentityOptions) dryRunCreate(resource string, obj, into runtime.Object) error {
+	return o.RESTClient.Post().
+		Resource(resource).
+		Param("dryRun", "All").
+		Body(obj).
+		Do().
+		Into(into)
+}
+
+// toExternalIdentity converts identity to the external, versioned type that
+// the API server and its OpenAPI schema actually deal in. The internal type
+// has no json tags and embeds TypeMeta/ObjectMeta without the "inline"/
+// "metadata" tags the v1 type carries, so marshaling it directly produces a
+// document with Go field names and a flattened metadata block instead of the
+// real wire shape.
+func (o *CreateIdentityOptions) toExternalIdentity(identity *userapi.Identity) (*userv1.Identity, error) {
+	external := &userv1.Identity{}
+	if err := userscheme.Scheme.Convert(identity, external, nil); err != nil {
+		return nil, err
+	}
+	external.GetObjectKind().SetGroupVersionKind(userv1.SchemeGroupVersion.WithKind("Identity"))
+	return external, nil
+}
+
+// validateObject runs OpenAPI schema validation of identity when --validate
+// is enabled, returning an error before anything is ever sent to the server.
+func (o *CreateIdentityOptions) validateObject(identity *userapi.Identity) error {
+	if !o.ValidateSchema {
+		return nil
+	}
+	external, err := o.toExternalIdentity(identity)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(external)
+	if err != nil {
+		return err
+	}
+	return o.Schema.ValidateBytes(data)
+}
+
+// editIdentity serializes identity, converted to the external versioned
+// type, to YAML, opens it in the user's editor, and re-parses the result
+// back into the internal type. If the file is saved unchanged, identity is
+// returned as-is.
+func (o *CreateIdentityOptions) editIdentity(identity *userapi.Identity) (*userapi.Identity, error) {
+	external, err := o.toExternalIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+	original, err := yaml.Marshal(external)
+	if err != nil {
+		return nil, err
+	}
+
+	edit := editor.NewDefaultEditor([]string{"OC_EDITOR", "EDITOR"})
+	editedFile, err := edit.LaunchTempFile("oc-create-identity-", ".yaml", bytes.NewBuffer(original))
+	if err != nil {
+		return nil, fmt.Errorf("error launching editor: %v", err)
+	}
+	defer os.Remove(editedFile)
+
+	edited, err := ioutil.ReadFile(editedFile)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(bytes.TrimSpace(original), bytes.TrimSpace(edited)) {
+		return identity, nil
+	}
+
+	editedExternal := &userv1.Identity{}
+	if err := yaml.Unmarshal(edited, editedExternal); err != nil {
+		return nil, fmt.Errorf("error parsing edited identity: %v", err)
+	}
+	result := &userapi.Identity{}
+	if err := userscheme.Scheme.Convert(editedExternal, result, nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readIdentityRows reads and parses identity rows from the given --filename
+// sources. Each source may be a local file, a directory (every CSV, JSON, or
+// YAML file in it is read), a http(s) URL, or "-" for stdin. Format is
+// inferred from the file (or URL path) extension; stdin, and a URL whose
+// path has no extension, are read as YAML.
+func readIdentityRows(filenames []string) ([]identityRow, error) {
+	rows := []identityRow{}
+	for _, filename := range filenames {
+		switch {
+		case filename == "-":
+			data, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, err
+			}
+			parsed, err := parseIdentityRows(data, ".yaml")
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, parsed...)
+
+		case strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://"):
+			resp, err := http.Get(filename)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+			ext := ".yaml"
+			if u, err := url.Parse(filename); err == nil && len(filepath.Ext(u.Path)) > 0 {
+				ext = filepath.Ext(u.Path)
+			}
+			parsed, err := parseIdentityRows(data, ext)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, parsed...)
+
+		default:
+			info, err := os.Stat(filename)
+			if err != nil {
+				return nil, err
+			}
+			paths := []string{filename}
+			if info.IsDir() {
+				paths = []string{}
+				err := filepath.Walk(filename, func(path string, fi os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					if fi.IsDir() {
+						return nil
+					}
+					switch filepath.Ext(path) {
+					case ".csv", ".json", ".yaml", ".yml":
+						paths = append(paths, path)
+					}
+					return nil
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			for _, path := range paths {
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return nil, err
+				}
+				parsed, err := parseIdentityRows(data, filepath.Ext(path))
+				if err != nil {
+					return nil, err
+				}
+				rows = append(rows, parsed...)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// parseIdentityRows decodes the given data as CSV, JSON, or YAML, selecting
+// the format based on ext (the source file extension, ".yaml" by default).
+func parseIdentityRows(data []byte, ext string) ([]identityRow, error) {
+	switch strings.ToLower(ext) {
+	case ".csv":
+		reader := csv.NewReader(bufio.NewReader(strings.NewReader(string(data))))
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		rows := []identityRow{}
+		for i, record := range records {
+			// Skip an optional "provider,provider_user,user" header row.
+			if i == 0 && len(record) == 3 && strings.EqualFold(record[0], "provider") {
+				continue
+			}
+			if len(record) != 3 {
+				return nil, fmt.Errorf("expected 3 columns (provider,provider_user,user), got %d", len(record))
+			}
+			rows = append(rows, identityRow{ProviderName: record[0], ProviderUserName: record[1], UserName: record[2]})
+		}
+		return rows, nil
+
+	case ".json", ".yaml", ".yml", "":
+		jsonData := data
+		if strings.ToLower(ext) != ".json" {
+			converted, err := yaml.YAMLToJSON(data)
+			if err != nil {
+				return nil, err
+			}
+			jsonData = converted
+		}
+		rows := []identityRow{}
+		if err := json.Unmarshal(jsonData, &rows); err != nil {
+			return nil, err
+		}
+		return rows, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported file type %q, expected .csv, .json, .yaml, or .yml", ext)
+	}
 }
@@ -0,0 +1,227 @@
+package create
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+
+	userapi "github.com/openshift/origin/pkg/user/apis/user"
+	userfake "github.com/openshift/origin/pkg/user/generated/internalclientset/fake"
+)
+
+// recordingSchema is a validation.Schema stub that captures the bytes it was
+// asked to validate, so tests can assert on their shape without depending on
+// a real OpenAPI document.
+type recordingSchema struct {
+	data []byte
+}
+
+func (s *recordingSchema) ValidateBytes(data []byte) error {
+	s.data = data
+	return nil
+}
+
+func TestValidateObjectMarshalsExternalShape(t *testing.T) {
+	schema := &recordingSchema{}
+	o := &CreateIdentityOptions{
+		ValidateSchema: true,
+		Schema:         schema,
+	}
+
+	identity := &userapi.Identity{}
+	identity.Name = "acme_ldap:adamjones"
+	identity.ProviderName = "acme_ldap"
+	identity.ProviderUserName = "adamjones"
+
+	if err := o.validateObject(identity); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Contains(schema.data, []byte(`"providerName"`)) {
+		t.Errorf("expected externally-tagged providerName field, got: %s", schema.data)
+	}
+	if bytes.Contains(schema.data, []byte(`"ProviderName"`)) {
+		t.Errorf("validated bytes should use the external type, not internal Go field names: %s", schema.data)
+	}
+	if !bytes.Contains(schema.data, []byte(`"metadata"`)) {
+		t.Errorf("expected a nested metadata block rather than flattened fields, got: %s", schema.data)
+	}
+}
+
+func TestParseIdentityRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		ext     string
+		want    []identityRow
+		wantErr bool
+	}{
+		{
+			name: "csv without header",
+			data: "acme_ldap,adamjones,adamjones\n",
+			ext:  ".csv",
+			want: []identityRow{{ProviderName: "acme_ldap", ProviderUserName: "adamjones", UserName: "adamjones"}},
+		},
+		{
+			name: "csv with header is skipped",
+			data: "provider,provider_user,user\nacme_ldap,adamjones,adamjones\n",
+			ext:  ".csv",
+			want: []identityRow{{ProviderName: "acme_ldap", ProviderUserName: "adamjones", UserName: "adamjones"}},
+		},
+		{
+			name:    "csv with wrong column count",
+			data:    "acme_ldap,adamjones\n",
+			ext:     ".csv",
+			wantErr: true,
+		},
+		{
+			name: "json array",
+			data: `[{"provider":"acme_ldap","provider_user":"adamjones","user":"adamjones"}]`,
+			ext:  ".json",
+			want: []identityRow{{ProviderName: "acme_ldap", ProviderUserName: "adamjones", UserName: "adamjones"}},
+		},
+		{
+			name: "yaml array",
+			data: "- provider: acme_ldap\n  provider_user: adamjones\n  user: adamjones\n",
+			ext:  ".yaml",
+			want: []identityRow{{ProviderName: "acme_ldap", ProviderUserName: "adamjones", UserName: "adamjones"}},
+		},
+		{
+			name:    "unsupported extension",
+			data:    "irrelevant",
+			ext:     ".txt",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseIdentityRows([]byte(tc.data), tc.ext)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got rows %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %d rows, got %d: %v", len(tc.want), len(got), got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("row %d: expected %+v, got %+v", i, tc.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateOneRollsBackIdentityWhenUserCreateFails(t *testing.T) {
+	client := userfake.NewSimpleClientset()
+	client.PrependReactor("create", "users", func(clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("user creation failed")
+	})
+
+	o := &CreateIdentityOptions{
+		IdentityClient: client.User().Identities(),
+		UserClient:     client.User().Users(),
+		MappingClient:  client.User().UserIdentityMappings(),
+		Out:            &bytes.Buffer{},
+	}
+
+	row := identityRow{ProviderName: "acme_ldap", ProviderUserName: "adamjones", UserName: "adamjones"}
+	if err := o.createOne(row, false); err == nil {
+		t.Fatal("expected an error from the failed user create")
+	}
+
+	if _, err := o.IdentityClient.Get("acme_ldap:adamjones", metav1.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the identity to be rolled back, got err=%v", err)
+	}
+}
+
+func TestRollbackIsNoopUnderDryRunServer(t *testing.T) {
+	client := userfake.NewSimpleClientset()
+	deleteCalled := false
+	client.PrependReactor("delete", "*", func(clienttesting.Action) (bool, runtime.Object, error) {
+		deleteCalled = true
+		return true, nil, nil
+	})
+
+	o := &CreateIdentityOptions{
+		IdentityClient: client.User().Identities(),
+		UserClient:     client.User().Users(),
+		DryRunStrategy: DryRunServer,
+		Out:            &bytes.Buffer{},
+	}
+
+	// DryRunServer never persists anything, so a pre-existing real object
+	// sharing the row's name must not be touched by rollback.
+	o.rollbackIdentity("acme_ldap:adamjones")
+	o.rollbackUser("adamjones")
+
+	if deleteCalled {
+		t.Error("expected rollback to be a no-op under DryRunServer, but a Delete call was made")
+	}
+}
+
+func TestCreateOneRollsBackIdentityAndUserWhenMappingCreateFails(t *testing.T) {
+	client := userfake.NewSimpleClientset()
+	client.PrependReactor("create", "useridentitymappings", func(clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("mapping creation failed")
+	})
+
+	o := &CreateIdentityOptions{
+		IdentityClient: client.User().Identities(),
+		UserClient:     client.User().Users(),
+		MappingClient:  client.User().UserIdentityMappings(),
+		Out:            &bytes.Buffer{},
+	}
+
+	row := identityRow{ProviderName: "acme_ldap", ProviderUserName: "adamjones", UserName: "adamjones"}
+	if err := o.createOne(row, false); err == nil {
+		t.Fatal("expected an error from the failed mapping create")
+	}
+
+	if _, err := o.IdentityClient.Get("acme_ldap:adamjones", metav1.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the identity to be rolled back, got err=%v", err)
+	}
+	if _, err := o.UserClient.Get("adamjones", metav1.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the user to be rolled back, got err=%v", err)
+	}
+}
+
+func TestCreateOneSucceeds(t *testing.T) {
+	client := userfake.NewSimpleClientset()
+	o := &CreateIdentityOptions{
+		IdentityClient: client.User().Identities(),
+		UserClient:     client.User().Users(),
+		MappingClient:  client.User().UserIdentityMappings(),
+		Out:            &bytes.Buffer{},
+	}
+
+	row := identityRow{ProviderName: "acme_ldap", ProviderUserName: "adamjones", UserName: "adamjones"}
+	if err := o.createOne(row, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := client.User().Identities().Get("acme_ldap:adamjones", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the identity to exist: %v", err)
+	}
+	if _, err := client.User().Users().Get("adamjones", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the user to exist: %v", err)
+	}
+	mapping, err := client.User().UserIdentityMappings().Get("acme_ldap:adamjones", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the mapping to exist: %v", err)
+	}
+	if mapping.Identity.Name != "acme_ldap:adamjones" || mapping.User.Name != "adamjones" {
+		t.Errorf("unexpected mapping references: %+v", mapping)
+	}
+}